@@ -1,15 +1,232 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"log"
+	"os"
+	"strconv"
 	"time"
+
+	"github.com/go-redis/redis/v8"
+	_ "github.com/lib/pq"
+
+	"github.com/Junnygram/new-security/src/redisconn"
 )
 
-func main() {
-	log.Println("Order Processor started...")
+var (
+	db  *sql.DB
+	rdb redisconn.RedisClient
+	ctx = context.Background()
+)
+
+// OrderMessage mirrors the payload buyHandler publishes to the "orders"
+// channel and pushes onto the "orders:queue" list.
+type OrderMessage struct {
+	OrderID   int    `json:"order_id"`
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+}
+
+// processingTimeout bounds how long a single order is allowed to sit in
+// the "processing" state before we give up and mark it failed.
+const processingTimeout = 30 * time.Second
+
+func initDB() {
+	var err error
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("DB_HOST"), os.Getenv("DB_PORT"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
+	// Retry loop for DB connection
+	for i := 0; i < 10; i++ {
+		db, err = sql.Open("postgres", connStr)
+		if err == nil {
+			err = db.Ping()
+		}
+		if err == nil {
+			log.Println("Connected to Database")
+			break
+		}
+		log.Printf("Failed to connect to DB, retrying... (%v)", err)
+		time.Sleep(2 * time.Second)
+	}
+
+	if err != nil {
+		log.Fatalf("Could not connect to database: %v", err)
+	}
+}
+
+func initRedis() {
+	var err error
+	rdb, err = redisconn.New()
+	if err != nil {
+		log.Fatalf("Could not configure Redis client: %v", err)
+	}
+
+	_, err = rdb.Ping(ctx).Result()
+	if err != nil {
+		log.Fatalf("Could not connect to Redis: %v", err)
+	}
+	log.Println("Connected to Redis")
+}
+
+// workerConcurrency reads WORKER_CONCURRENCY, defaulting to 4 workers.
+func workerConcurrency() int {
+	if v := os.Getenv("WORKER_CONCURRENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 4
+}
+
+// recoverPendingOrders re-enqueues orders left in "pending" state, which
+// covers the case where the worker was down when buyHandler published to
+// the "orders" pub/sub channel (Redis Pub/Sub drops messages with no
+// subscriber connected).
+func recoverPendingOrders(work chan<- OrderMessage) {
+	rows, err := db.Query("SELECT id, product_id, quantity FROM orders WHERE status = 'pending'")
+	if err != nil {
+		log.Printf("Failed to load pending orders on startup: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var recovered int
+	for rows.Next() {
+		var msg OrderMessage
+		if err := rows.Scan(&msg.OrderID, &msg.ProductID, &msg.Quantity); err != nil {
+			log.Printf("Failed to scan pending order: %v", err)
+			continue
+		}
+		work <- msg
+		recovered++
+	}
+	if recovered > 0 {
+		log.Printf("Recovered %d pending order(s) from the database on startup", recovered)
+	}
+}
+
+// subscribeLoop feeds work from the "orders" pub/sub channel.
+func subscribeLoop(work chan<- OrderMessage) {
+	sub := rdb.Subscribe(ctx, "orders")
+	defer sub.Close()
+
+	for msg := range sub.Channel() {
+		var order OrderMessage
+		if err := json.Unmarshal([]byte(msg.Payload), &order); err != nil {
+			log.Printf("Failed to decode pub/sub order message: %v", err)
+			continue
+		}
+		work <- order
+	}
+}
+
+// queueLoop feeds work from the "orders:queue" list via BRPOP, which
+// catches orders published while no subscriber was connected.
+func queueLoop(work chan<- OrderMessage) {
 	for {
-		log.Println("Checking for new orders...")
-		// Simulate processing work
-		time.Sleep(10 * time.Second)
+		result, err := rdb.BRPop(ctx, 5*time.Second, "orders:queue").Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Printf("BRPOP error on orders:queue: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		// result[0] is the list key, result[1] is the payload.
+		var order OrderMessage
+		if err := json.Unmarshal([]byte(result[1]), &order); err != nil {
+			log.Printf("Failed to decode queued order message: %v", err)
+			continue
+		}
+		work <- order
+	}
+}
+
+// processOrder drives a single order through pending -> processing ->
+// completed (or failed), logging id, latency, and outcome so the two
+// binaries can be correlated in the logs.
+//
+// buyHandler both publishes to the "orders" channel and LPushes onto
+// "orders:queue", and a missed pub/sub notification can also be recovered
+// from the database on startup, so the same order can legitimately reach
+// this function more than once. claimOrder makes that safe: only the
+// delivery that wins the pending->processing transition proceeds, so a
+// redelivery is a no-op instead of a second DB write.
+func processOrder(msg OrderMessage) {
+	start := time.Now()
+	opCtx, cancel := context.WithTimeout(ctx, processingTimeout)
+	defer cancel()
+
+	claimed, err := claimOrder(opCtx, msg.OrderID)
+	if err != nil {
+		log.Printf("order_id=%d status=processing error=%v", msg.OrderID, err)
+		return
 	}
+	if !claimed {
+		log.Printf("order_id=%d outcome=duplicate_skipped", msg.OrderID)
+		return
+	}
+
+	outcome := "completed"
+	if err := setStatus(opCtx, msg.OrderID, "completed"); err != nil {
+		log.Printf("order_id=%d status=completed error=%v", msg.OrderID, err)
+		outcome = "failed"
+		// Best-effort: mark the order failed on the background context in
+		// case the per-order timeout above already expired.
+		if err := setStatus(context.Background(), msg.OrderID, "failed"); err != nil {
+			log.Printf("order_id=%d status=failed error=%v", msg.OrderID, err)
+		}
+	}
+
+	log.Printf("order_id=%d product_id=%s quantity=%d latency_ms=%d outcome=%s",
+		msg.OrderID, msg.ProductID, msg.Quantity, time.Since(start).Milliseconds(), outcome)
+}
+
+// claimOrder atomically transitions an order from pending to processing.
+// It returns false if the order wasn't pending, meaning another delivery
+// of the same message already claimed (or finished) it.
+func claimOrder(opCtx context.Context, orderID int) (bool, error) {
+	res, err := db.ExecContext(opCtx, "UPDATE orders SET status='processing' WHERE id=$1 AND status='pending'", orderID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
+
+func setStatus(opCtx context.Context, orderID int, status string) error {
+	_, err := db.ExecContext(opCtx, "UPDATE orders SET status=$1 WHERE id=$2", status, orderID)
+	return err
+}
+
+func main() {
+	initDB()
+	initRedis()
+
+	concurrency := workerConcurrency()
+	work := make(chan OrderMessage, 256)
+
+	for i := 0; i < concurrency; i++ {
+		go func(workerID int) {
+			for msg := range work {
+				processOrder(msg)
+			}
+		}(i)
+	}
+
+	recoverPendingOrders(work)
+	go subscribeLoop(work)
+	go queueLoop(work)
+
+	log.Printf("Order Processor started with %d worker(s)...", concurrency)
+	select {}
 }
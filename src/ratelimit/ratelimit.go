@@ -0,0 +1,97 @@
+// Package ratelimit implements a Redis-backed token-bucket rate limiter,
+// suitable for sharing a limit across every instance of a service.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Junnygram/new-security/src/redisconn"
+)
+
+// ErrRateLimited is returned by Allow when the caller has been rejected
+// because the wait for enough tokens would exceed maxWait.
+var ErrRateLimited = errors.New("ratelimit: rate limit exceeded")
+
+// tokenBucketScript refills a per-key bucket based on elapsed server time
+// and either deducts the requested tokens or reports how long the caller
+// would need to wait for them. Using redis.call("TIME") instead of a
+// client-supplied timestamp keeps the bucket correct across callers with
+// skewed clocks.
+const tokenBucketScript = `
+local key = KEYS[1]
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local requested = tonumber(ARGV[3])
+
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local data = redis.call("HMGET", key, "tokens", "ts")
+local tokens = tonumber(data[1])
+local ts = tonumber(data[2])
+if tokens == nil then
+	tokens = burst
+	ts = now
+end
+
+local elapsed = math.max(0, now - ts)
+tokens = math.min(burst, tokens + (elapsed * rate / 1000))
+
+local wait_ms = 0
+if tokens >= requested then
+	tokens = tokens - requested
+else
+	local deficit = requested - tokens
+	wait_ms = math.ceil(deficit * 1000 / rate)
+end
+
+redis.call("HMSET", key, "tokens", tokens, "ts", now)
+redis.call("EXPIRE", key, 3600)
+return wait_ms
+`
+
+// Limiter is a token bucket backed by Redis: tokens accrue at rate per
+// second up to burst, and Allow deducts tokens or waits for them.
+type Limiter struct {
+	rdb   redisconn.RedisClient
+	rate  int64
+	burst int64
+}
+
+// New builds a Limiter that refills at rate tokens/second up to burst.
+func New(rdb redisconn.RedisClient, rate, burst int64) *Limiter {
+	return &Limiter{rdb: rdb, rate: rate, burst: burst}
+}
+
+// Allow attempts to deduct tokens from key's bucket. If the bucket is
+// short, Allow sleeps server-side for as long as maxWait allows and
+// retries; if the shortfall would take longer than maxWait to clear, it
+// returns ErrRateLimited along with the wait, in milliseconds, the caller
+// would have needed (useful for a Retry-After header).
+func (l *Limiter) Allow(ctx context.Context, key string, tokens int64, maxWait time.Duration) (waitMillis int64, err error) {
+	deadline := time.Now().Add(maxWait)
+	for {
+		wait, err := l.tryAcquire(ctx, key, tokens)
+		if err != nil {
+			return 0, err
+		}
+		if wait == 0 {
+			return 0, nil
+		}
+		if time.Now().Add(time.Duration(wait) * time.Millisecond).After(deadline) {
+			return wait, ErrRateLimited
+		}
+
+		select {
+		case <-time.After(time.Duration(wait) * time.Millisecond):
+		case <-ctx.Done():
+			return wait, ctx.Err()
+		}
+	}
+}
+
+func (l *Limiter) tryAcquire(ctx context.Context, key string, tokens int64) (int64, error) {
+	return l.rdb.Eval(ctx, tokenBucketScript, []string{key}, l.rate, l.burst, tokens).Int64()
+}
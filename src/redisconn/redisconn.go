@@ -0,0 +1,141 @@
+// Package redisconn builds a Redis client from environment configuration,
+// supporting single-node, Sentinel, and Cluster topologies behind one
+// interface so a checkout path doesn't have a single point of failure
+// pinned to one Redis node.
+package redisconn
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisClient covers the ops the store-api and order-processor binaries
+// actually use, so both *redis.Client (single-node and Sentinel) and
+// *redis.ClusterClient satisfy it and callers don't need to care which
+// topology is in play.
+type RedisClient interface {
+	Ping(ctx context.Context) *redis.StatusCmd
+	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd
+	LPush(ctx context.Context, key string, values ...interface{}) *redis.IntCmd
+	BRPop(ctx context.Context, timeout time.Duration, keys ...string) *redis.StringSliceCmd
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	Get(ctx context.Context, key string) *redis.StringCmd
+	IncrBy(ctx context.Context, key string, value int64) *redis.IntCmd
+	DecrBy(ctx context.Context, key string, decrement int64) *redis.IntCmd
+}
+
+// New selects a client mode from REDIS_MODE (single, sentinel, cluster;
+// default single) and builds the corresponding client from environment
+// configuration.
+func New() (RedisClient, error) {
+	mode := strings.ToLower(os.Getenv("REDIS_MODE"))
+	if mode == "" {
+		mode = "single"
+	}
+
+	tlsConfig, err := buildTLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("redisconn: %w", err)
+	}
+
+	switch mode {
+	case "single":
+		addr := fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT"))
+		log.Printf("redisconn: connecting in single-node mode to %s", addr)
+		return redis.NewClient(&redis.Options{
+			Addr:      addr,
+			Username:  os.Getenv("REDIS_USERNAME"),
+			Password:  os.Getenv("REDIS_PASSWORD"),
+			TLSConfig: tlsConfig,
+		}), nil
+
+	case "sentinel":
+		addrs := splitAddrs(os.Getenv("REDIS_SENTINEL_ADDRS"))
+		masterName := os.Getenv("REDIS_MASTER_NAME")
+		if len(addrs) == 0 || masterName == "" {
+			return nil, fmt.Errorf("redisconn: REDIS_SENTINEL_ADDRS and REDIS_MASTER_NAME are required for sentinel mode")
+		}
+		log.Printf("redisconn: connecting in sentinel mode via %v (master=%s)", addrs, masterName)
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    masterName,
+			SentinelAddrs: addrs,
+			Username:      os.Getenv("REDIS_USERNAME"),
+			Password:      os.Getenv("REDIS_PASSWORD"),
+			TLSConfig:     tlsConfig,
+		}), nil
+
+	case "cluster":
+		addrs := splitAddrs(os.Getenv("REDIS_CLUSTER_ADDRS"))
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("redisconn: REDIS_CLUSTER_ADDRS is required for cluster mode")
+		}
+		log.Printf("redisconn: connecting in cluster mode via %v", addrs)
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     addrs,
+			Username:  os.Getenv("REDIS_USERNAME"),
+			Password:  os.Getenv("REDIS_PASSWORD"),
+			TLSConfig: tlsConfig,
+		}), nil
+
+	default:
+		return nil, fmt.Errorf("redisconn: unknown REDIS_MODE %q (want single, sentinel, or cluster)", mode)
+	}
+}
+
+func splitAddrs(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	parts := strings.Split(raw, ",")
+	addrs := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			addrs = append(addrs, p)
+		}
+	}
+	return addrs
+}
+
+// buildTLSConfig returns nil when REDIS_TLS isn't set to "true", matching
+// the plaintext behavior existing deployments rely on.
+func buildTLSConfig() (*tls.Config, error) {
+	if strings.ToLower(os.Getenv("REDIS_TLS")) != "true" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{}
+
+	certPath := os.Getenv("REDIS_TLS_CERT")
+	keyPath := os.Getenv("REDIS_TLS_KEY")
+	if certPath != "" && keyPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS client cert/key: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if caPath := os.Getenv("REDIS_TLS_CA"); caPath != "" {
+		ca, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading TLS CA %s: %w", caPath, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in TLS CA %s", caPath)
+		}
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
@@ -1,24 +1,47 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"strings"
+	"strconv"
 	"time"
+	"unicode"
 
-	"github.com/go-redis/redis/v8"
 	_ "github.com/lib/pq"
+
+	"github.com/Junnygram/new-security/src/ratelimit"
+	"github.com/Junnygram/new-security/src/redisconn"
+	"github.com/Junnygram/new-security/src/validate"
 )
 
+// maxRequestBodyBytes caps request bodies so a single caller can't exhaust
+// memory decoding an oversized payload.
+const maxRequestBodyBytes = 1 << 20 // 1 MiB
+
 var (
-	db  *sql.DB
-	rdb *redis.Client
-	ctx = context.Background()
+	db      *sql.DB
+	rdb     redisconn.RedisClient
+	limiter *ratelimit.Limiter
+	ctx     = context.Background()
+)
+
+// Rate limiter defaults, overridable via RATE_LIMIT_RATE, RATE_LIMIT_BURST
+// and RATE_LIMIT_MAX_WAIT_MS.
+const (
+	defaultRateLimitRate      = 50
+	defaultRateLimitBurst     = 100
+	defaultRateLimitMaxWaitMs = 200
 )
 
 type OrderRequest struct {
@@ -34,6 +57,133 @@ type Order struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// Product mirrors a row of the products table.
+type Product struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Stock   int    `json:"stock"`
+	Version int    `json:"version"`
+}
+
+// maxStockRetries bounds the number of optimistic-lock retries on a
+// version conflict before we give up and roll back the Redis reservation.
+const maxStockRetries = 5
+
+// decrStockScript atomically decrements the Redis stock counter and undoes
+// the decrement if it would go negative, so a burst of requests can never
+// push the counter below zero even though DECRBY itself has no floor.
+const decrStockScript = `
+local stock = redis.call("DECRBY", KEYS[1], ARGV[1])
+if stock < 0 then
+	redis.call("INCRBY", KEYS[1], ARGV[1])
+	return -1
+end
+return stock
+`
+
+// idempotencyTTL is how long a response is replayed for a repeated
+// Idempotency-Key, and how long the reservation guards against concurrent
+// duplicates while the original request is still in flight.
+const idempotencyTTL = 24 * time.Hour
+
+const maxIdempotencyKeyLen = 255
+
+// idempReserveScript claims the key with a "pending" placeholder unless it
+// already exists, giving us the NX+EX semantics through Eval, since the
+// RedisClient interface's Set has no NX option.
+const idempReserveScript = `
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "EX", ARGV[2]) then
+	return 1
+end
+return 0
+`
+
+const idempDeleteScript = `
+redis.call("DEL", KEYS[1])
+return 1
+`
+
+// storedIdempotentResponse is what gets marshaled into Redis so a repeated
+// request can be replayed byte-for-byte, same status code and body.
+type storedIdempotentResponse struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body"`
+}
+
+func validateIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLen {
+		return fmt.Errorf("idempotency key exceeds %d characters", maxIdempotencyKeyLen)
+	}
+	for _, r := range key {
+		if r > unicode.MaxASCII {
+			return fmt.Errorf("idempotency key must be ASCII")
+		}
+	}
+	return nil
+}
+
+func idempotencyRedisKey(idemKey string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(idemKey))
+	h.Write(body)
+	return "idem:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// reserveIdempotencyKey claims key for the in-flight request. It returns
+// false if another request (in flight or already completed) got there
+// first.
+func reserveIdempotencyKey(key string) (bool, error) {
+	result, err := rdb.Eval(ctx, idempReserveScript, []string{key}, "pending", int(idempotencyTTL.Seconds())).Int()
+	if err != nil {
+		return false, err
+	}
+	return result == 1, nil
+}
+
+// releaseIdempotencyKey drops a reservation after the request it guarded
+// failed, so a retry with the same key isn't stuck behind a stale
+// "pending" placeholder for the full TTL.
+func releaseIdempotencyKey(key string) {
+	if err := rdb.Eval(ctx, idempDeleteScript, []string{key}).Err(); err != nil {
+		log.Printf("Failed to release idempotency key %s: %v", key, err)
+	}
+}
+
+// loadIdempotentResponse returns nil if the key still holds the "pending"
+// placeholder, i.e. the original request hasn't finished yet.
+func loadIdempotentResponse(key string) (*storedIdempotentResponse, error) {
+	val, err := rdb.Get(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if val == "pending" {
+		return nil, nil
+	}
+
+	var resp storedIdempotentResponse
+	if err := json.Unmarshal([]byte(val), &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func storeIdempotentResponse(key string, statusCode int, body []byte) {
+	data, err := json.Marshal(storedIdempotentResponse{StatusCode: statusCode, Body: body})
+	if err != nil {
+		log.Printf("Failed to marshal idempotent response for %s: %v", key, err)
+		return
+	}
+	if err := rdb.Set(ctx, key, data, idempotencyTTL).Err(); err != nil {
+		log.Printf("Failed to store idempotent response for %s: %v", key, err)
+	}
+}
+
+func writeStoredResponse(w http.ResponseWriter, resp *storedIdempotentResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(resp.Body)
+}
+
 func initDB() {
 	var err error
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
@@ -69,27 +219,128 @@ func initDB() {
 	if err != nil {
 		log.Fatalf("Failed to create table: %v", err)
 	}
+
+	createProductsTableQuery := `
+	CREATE TABLE IF NOT EXISTS products (
+		id VARCHAR(64) PRIMARY KEY,
+		name VARCHAR(255),
+		stock INT NOT NULL DEFAULT 0,
+		version INT NOT NULL DEFAULT 0
+	)`
+	_, err = db.Exec(createProductsTableQuery)
+	if err != nil {
+		log.Fatalf("Failed to create products table: %v", err)
+	}
 }
 
 func initRedis() {
-	rdb = redis.NewClient(&redis.Options{
-		Addr: fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")),
-	})
-
-	_, err := rdb.Ping(ctx).Result()
+	var err error
+	rdb, err = redisconn.New()
 	if err != nil {
+		log.Fatalf("Could not configure Redis client: %v", err)
+	}
+
+	if _, err := rdb.Ping(ctx).Result(); err != nil {
 		log.Fatalf("Could not connect to Redis: %v", err)
 	}
 	log.Println("Connected to Redis")
 }
 
-// SanitizeInput removes potentially dangerous characters
-func SanitizeInput(input string) string {
-	safe := strings.ReplaceAll(input, "<", "")
-	safe = strings.ReplaceAll(safe, ">", "")
-	safe = strings.ReplaceAll(safe, "'", "")
-	safe = strings.ReplaceAll(safe, ";", "")
-	return safe
+func initRateLimiter() {
+	rate := envInt64("RATE_LIMIT_RATE", defaultRateLimitRate)
+	burst := envInt64("RATE_LIMIT_BURST", defaultRateLimitBurst)
+	limiter = ratelimit.New(rdb, rate, burst)
+	log.Printf("Rate limiter configured: rate=%d/s burst=%d", rate, burst)
+}
+
+func envInt64(name string, fallback int64) int64 {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
+func rateLimitMaxWait() time.Duration {
+	return time.Duration(envInt64("RATE_LIMIT_MAX_WAIT_MS", defaultRateLimitMaxWaitMs)) * time.Millisecond
+}
+
+// clientIP extracts the caller's address for per-IP rate limiting.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeValidationError reports every offending field at once rather than
+// bailing out on the first one.
+func writeValidationError(w http.ResponseWriter, fields map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "validation_failed",
+		"fields": fields,
+	})
+}
+
+func stockKey(productID string) string {
+	return "stock:" + productID
+}
+
+// reserveStock does the cheap Redis pre-check that shields the DB from the
+// thundering herd. It returns false if the product is out of stock.
+func reserveStock(productID string, qty int) (bool, error) {
+	result, err := rdb.Eval(ctx, decrStockScript, []string{stockKey(productID)}, qty).Int()
+	if err != nil {
+		return false, err
+	}
+	return result >= 0, nil
+}
+
+// releaseStock restores a Redis reservation, used when the DB side of the
+// purchase fails after the Redis pre-check already succeeded.
+func releaseStock(productID string, qty int) {
+	if err := rdb.IncrBy(ctx, stockKey(productID), int64(qty)).Err(); err != nil {
+		log.Printf("Failed to release Redis stock reservation for %s: %v", productID, err)
+	}
+}
+
+// deductStock applies the durable decrement in Postgres using optimistic
+// locking, retrying on version conflicts caused by concurrent buyers.
+func deductStock(productID string, qty int) (bool, error) {
+	for attempt := 0; attempt < maxStockRetries; attempt++ {
+		var version, stock int
+		err := db.QueryRow("SELECT version, stock FROM products WHERE id = $1", productID).Scan(&version, &stock)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if stock < qty {
+			return false, nil
+		}
+
+		res, err := db.Exec(
+			"UPDATE products SET stock = stock - $1, version = version + 1 WHERE id = $2 AND version = $3 AND stock >= $1",
+			qty, productID, version)
+		if err != nil {
+			return false, err
+		}
+
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		if rows == 1 {
+			return true, nil
+		}
+		// Someone else updated the row between our SELECT and UPDATE; retry.
+	}
+	return false, fmt.Errorf("exhausted %d retries updating stock for %s", maxStockRetries, productID)
 }
 
 func buyHandler(w http.ResponseWriter, r *http.Request) {
@@ -98,19 +349,108 @@ func buyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
 	var req OrderRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	dec := json.NewDecoder(bytes.NewReader(bodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	safeProductID := SanitizeInput(req.ProductID)
+	if fields := validate.OrderRequest(req.ProductID, req.Quantity); fields != nil {
+		writeValidationError(w, fields)
+		return
+	}
+
+	// An Idempotency-Key turns /buy into an at-most-once endpoint: the
+	// first request to claim a key runs the happy path below and, if it
+	// succeeds, caches its response; every retry with the same key+body
+	// replays it. A request that fails releases the key, so a retry runs
+	// again.
+	var idemRedisKey string
+	if idemKey := r.Header.Get("Idempotency-Key"); idemKey != "" {
+		if err := validateIdempotencyKey(idemKey); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		idemRedisKey = idempotencyRedisKey(idemKey, bodyBytes)
+
+		reserved, err := reserveIdempotencyKey(idemRedisKey)
+		if err != nil {
+			http.Error(w, "Idempotency store error", http.StatusInternalServerError)
+			log.Printf("Idempotency reservation error for key %s: %v", idemRedisKey, err)
+			return
+		}
+		if !reserved {
+			stored, err := loadIdempotentResponse(idemRedisKey)
+			if err != nil {
+				http.Error(w, "Idempotency store error", http.StatusInternalServerError)
+				log.Printf("Idempotency lookup error for key %s: %v", idemRedisKey, err)
+				return
+			}
+			if stored == nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(map[string]string{"status": "in_progress"})
+				return
+			}
+			writeStoredResponse(w, stored)
+			return
+		}
+	}
+
+	maxWait := rateLimitMaxWait()
+	if rejected := checkRateLimit(w, r, "rl:ip:"+clientIP(r), maxWait); rejected {
+		releaseIdempotencyKeyIfSet(idemRedisKey)
+		return
+	}
+	if rejected := checkRateLimit(w, r, "rl:prod:"+req.ProductID, maxWait); rejected {
+		releaseIdempotencyKeyIfSet(idemRedisKey)
+		return
+	}
+
+	reserved, err := reserveStock(req.ProductID, req.Quantity)
+	if err != nil {
+		releaseIdempotencyKeyIfSet(idemRedisKey)
+		http.Error(w, "Inventory service error", http.StatusInternalServerError)
+		log.Printf("Redis stock reservation error for %s: %v", req.ProductID, err)
+		return
+	}
+	if !reserved {
+		releaseIdempotencyKeyIfSet(idemRedisKey)
+		writeOutOfStock(w)
+		return
+	}
+
+	deducted, err := deductStock(req.ProductID, req.Quantity)
+	if err != nil {
+		releaseStock(req.ProductID, req.Quantity)
+		releaseIdempotencyKeyIfSet(idemRedisKey)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("DB stock deduction error for %s: %v", req.ProductID, err)
+		return
+	}
+	if !deducted {
+		releaseStock(req.ProductID, req.Quantity)
+		releaseIdempotencyKeyIfSet(idemRedisKey)
+		writeOutOfStock(w)
+		return
+	}
 
 	// insert into DB
 	var orderID int
-	err := db.QueryRow("INSERT INTO orders (product_id, quantity, status) VALUES ($1, $2, 'pending') RETURNING id",
-		safeProductID, req.Quantity).Scan(&orderID)
+	err = db.QueryRow("INSERT INTO orders (product_id, quantity, status) VALUES ($1, $2, 'pending') RETURNING id",
+		req.ProductID, req.Quantity).Scan(&orderID)
 	if err != nil {
+		releaseStock(req.ProductID, req.Quantity)
+		releaseIdempotencyKeyIfSet(idemRedisKey)
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		log.Printf("DB Insert Error: %v", err)
 		return
@@ -119,7 +459,7 @@ func buyHandler(w http.ResponseWriter, r *http.Request) {
 	// Publish to Redis
 	orderMsg := map[string]interface{}{
 		"order_id":   orderID,
-		"product_id": safeProductID,
+		"product_id": req.ProductID,
 		"quantity":   req.Quantity,
 	}
 	msgBytes, _ := json.Marshal(orderMsg)
@@ -128,15 +468,130 @@ func buyHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Redis Publish Error: %v", err)
 		// Don't fail the request if redis fails, just log it (or handle retry)
 	}
+	// Pub/Sub drops messages when no subscriber is connected, so also push
+	// onto a durable list the order-processor can BRPOP as a fallback.
+	if err := rdb.LPush(ctx, "orders:queue", msgBytes).Err(); err != nil {
+		log.Printf("Redis LPush Error: %v", err)
+	}
+
+	log.Printf("Processed order #%d for ProductID: %s", orderID, req.ProductID)
+
+	respBody, _ := json.Marshal(map[string]interface{}{
+		"status":     "Order processed",
+		"product_id": req.ProductID,
+		"order_id":   orderID,
+	})
 
-	log.Printf("Processed order #%d for ProductID: %s", orderID, safeProductID)
+	if idemRedisKey != "" {
+		storeIdempotentResponse(idemRedisKey, http.StatusOK, respBody)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+}
+
+func releaseIdempotencyKeyIfSet(idemRedisKey string) {
+	if idemRedisKey != "" {
+		releaseIdempotencyKey(idemRedisKey)
+	}
+}
+
+// checkRateLimit consults the limiter for key and, if the caller must be
+// rejected, writes the 429 response and returns true. If the limiter itself
+// fails, it writes a 500 response and also returns true.
+func checkRateLimit(w http.ResponseWriter, r *http.Request, key string, maxWait time.Duration) bool {
+	waitMillis, err := limiter.Allow(r.Context(), key, 1, maxWait)
+	if err == nil {
+		return false
+	}
+	if err != ratelimit.ErrRateLimited {
+		http.Error(w, "Rate limiter error", http.StatusInternalServerError)
+		log.Printf("Rate limiter error for key %s: %v", key, err)
+		return true
+	}
+
+	retryAfterSeconds := (waitMillis + 999) / 1000
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfterSeconds, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]string{"error": "rate_limited"})
+	return true
+}
+
+func writeOutOfStock(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]string{"error": "out_of_stock"})
+}
+
+// requireAdminToken gates the admin-only endpoints behind a shared secret
+// sent as X-Admin-Token, so anyone who can reach the service can't mutate
+// inventory outright. If ADMIN_TOKEN isn't configured the endpoint refuses
+// every request rather than failing open.
+func requireAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	expected := os.Getenv("ADMIN_TOKEN")
+	if expected == "" {
+		http.Error(w, "Admin endpoint not configured", http.StatusServiceUnavailable)
+		log.Printf("Rejected admin request: ADMIN_TOKEN is not configured")
+		return false
+	}
+
+	provided := r.Header.Get("X-Admin-Token")
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(expected)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// productsHandler is the admin endpoint used to seed or restock a product.
+// It upserts the Postgres row and warms the Redis counter that buyHandler
+// reads on the hot path. Requires the X-Admin-Token header (see
+// requireAdminToken); it is not meant to be reachable from outside the
+// admin/operator boundary.
+func productsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdminToken(w, r) {
+		return
+	}
+
+	var p Product
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if fields := validate.ProductID(p.ID); fields != nil {
+		writeValidationError(w, fields)
+		return
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO products (id, name, stock, version) VALUES ($1, $2, $3, 0)
+		ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, stock = EXCLUDED.stock, version = products.version + 1`,
+		p.ID, p.Name, p.Stock)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("DB Upsert Product Error: %v", err)
+		return
+	}
+
+	if err := rdb.Set(ctx, stockKey(p.ID), p.Stock, 0).Err(); err != nil {
+		http.Error(w, "Failed to warm cache", http.StatusInternalServerError)
+		log.Printf("Redis Set Stock Error: %v", err)
+		return
+	}
+
+	log.Printf("Seeded product %s with stock %d", p.ID, p.Stock)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":     "Order processed",
-		"product_id": safeProductID,
-		"order_id":   orderID,
+		"status":  "product_seeded",
+		"product": p,
 	})
 }
 
@@ -148,6 +603,7 @@ func main() {
 
 	initDB()
 	initRedis()
+	initRateLimiter()
 
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -155,6 +611,7 @@ func main() {
 	})
 
 	http.HandleFunc("/buy", buyHandler)
+	http.HandleFunc("/products", productsHandler)
 
 	log.Printf("Store API (Secure) starting on port %s...", port)
 	if err := http.ListenAndServe(":"+port, nil); err != nil {
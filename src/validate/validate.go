@@ -0,0 +1,54 @@
+// Package validate enforces schema-level rules on API inputs. It replaces
+// blacklist-style sanitization, which neither stops SQL injection (the
+// driver already parameterizes queries) nor validates business rules.
+package validate
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+var productIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+const defaultMaxQtyPerOrder = 100
+
+// MaxQtyPerOrder reads MAX_QTY_PER_ORDER, falling back to a sane default.
+func MaxQtyPerOrder() int {
+	if v := os.Getenv("MAX_QTY_PER_ORDER"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultMaxQtyPerOrder
+}
+
+// OrderRequest validates the fields of a buy request, returning every
+// offending field keyed by name, or nil if the request is valid.
+func OrderRequest(productID string, quantity int) map[string]string {
+	fields := map[string]string{}
+
+	if !productIDPattern.MatchString(productID) {
+		fields["product_id"] = "must match ^[A-Za-z0-9_-]{1,64}$"
+	}
+
+	maxQty := MaxQtyPerOrder()
+	if quantity < 1 || quantity > maxQty {
+		fields["quantity"] = fmt.Sprintf("must be between 1 and %d", maxQty)
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// ProductID validates a standalone product identifier, e.g. for the admin
+// product-seeding endpoint.
+func ProductID(id string) map[string]string {
+	if productIDPattern.MatchString(id) {
+		return nil
+	}
+	return map[string]string{"id": "must match ^[A-Za-z0-9_-]{1,64}$"}
+}
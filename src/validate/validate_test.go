@@ -0,0 +1,84 @@
+package validate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOrderRequest(t *testing.T) {
+	tests := []struct {
+		name          string
+		productID     string
+		quantity      int
+		maxQtyPerEnv  string
+		wantFields    []string
+		wantNoFailure bool
+	}{
+		{name: "valid", productID: "sku-123_A", quantity: 1, wantNoFailure: true},
+		{name: "empty product id", productID: "", quantity: 1, wantFields: []string{"product_id"}},
+		{name: "product id too long", productID: strings.Repeat("a", 65), quantity: 1, wantFields: []string{"product_id"}},
+		{name: "product id max length ok", productID: strings.Repeat("a", 64), quantity: 1, wantNoFailure: true},
+		{name: "product id bad characters", productID: "sku 123!", quantity: 1, wantFields: []string{"product_id"}},
+		{name: "quantity zero", productID: "sku-1", quantity: 0, wantFields: []string{"quantity"}},
+		{name: "quantity negative", productID: "sku-1", quantity: -1, wantFields: []string{"quantity"}},
+		{name: "quantity over default max", productID: "sku-1", quantity: 101, wantFields: []string{"quantity"}},
+		{name: "quantity at default max", productID: "sku-1", quantity: 100, wantNoFailure: true},
+		{name: "quantity within overridden max", productID: "sku-1", quantity: 5, maxQtyPerEnv: "5", wantNoFailure: true},
+		{name: "quantity over overridden max", productID: "sku-1", quantity: 6, maxQtyPerEnv: "5", wantFields: []string{"quantity"}},
+		{name: "both fields invalid", productID: "", quantity: 0, wantFields: []string{"product_id", "quantity"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.maxQtyPerEnv != "" {
+				t.Setenv("MAX_QTY_PER_ORDER", tt.maxQtyPerEnv)
+			}
+
+			fields := OrderRequest(tt.productID, tt.quantity)
+
+			if tt.wantNoFailure {
+				if fields != nil {
+					t.Fatalf("OrderRequest(%q, %d) = %v, want nil", tt.productID, tt.quantity, fields)
+				}
+				return
+			}
+
+			if fields == nil {
+				t.Fatalf("OrderRequest(%q, %d) = nil, want failures for %v", tt.productID, tt.quantity, tt.wantFields)
+			}
+			if len(fields) != len(tt.wantFields) {
+				t.Fatalf("OrderRequest(%q, %d) = %v, want failures for exactly %v", tt.productID, tt.quantity, fields, tt.wantFields)
+			}
+			for _, f := range tt.wantFields {
+				if _, ok := fields[f]; !ok {
+					t.Errorf("OrderRequest(%q, %d) missing expected field %q, got %v", tt.productID, tt.quantity, f, fields)
+				}
+			}
+		})
+	}
+}
+
+func TestProductID(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		wantErr bool
+	}{
+		{name: "valid", id: "sku-123_A", wantErr: false},
+		{name: "empty", id: "", wantErr: true},
+		{name: "too long", id: strings.Repeat("a", 65), wantErr: true},
+		{name: "max length ok", id: strings.Repeat("a", 64), wantErr: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := ProductID(tt.id)
+			if tt.wantErr && fields == nil {
+				t.Fatalf("ProductID(%q) = nil, want validation error", tt.id)
+			}
+			if !tt.wantErr && fields != nil {
+				t.Fatalf("ProductID(%q) = %v, want nil", tt.id, fields)
+			}
+		})
+	}
+}